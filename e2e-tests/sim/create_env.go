@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"vim-arcade.theprimeagen.com/pkg/assert"
 	"vim-arcade.theprimeagen.com/pkg/dummy"
@@ -24,14 +26,39 @@ type ServerState struct {
     Port int
     Factory *TestingClientFactory
     Conns ConnMap
+    Diagnostics *http.Server
+    DiagnosticsAddr string
+
+    // cancel stops the context that was threaded through construction
+    // (mm.Run, Hydrate, and therefore every connect goroutine it spawned).
+    // RunUntilSignal calls it so a signal actually unwinds in-flight
+    // connects instead of only being bounded by its grace timeout.
+    cancel context.CancelFunc
 }
 
+// Close tears down whatever parts of the environment were actually built.
+// It is safe to call on a ServerState returned from a failed
+// CreateEnvironmentE (deferred right after the call), and safe to call
+// more than once.
 func (s *ServerState) Close() {
-    s.MatchMaking.Close()
-    s.Server.Close()
+    if s.cancel != nil {
+        s.cancel()
+    }
+    s.closeDiagnostics()
 
-    err := s.Sqlite.Close()
-    assert.NoError(err, "sqlite errored on close")
+    if s.MatchMaking != nil {
+        s.MatchMaking.Close()
+        s.MatchMaking = nil
+    }
+    if s.Server != nil {
+        s.Server.Close()
+        s.Server = nil
+    }
+    if s.Sqlite != nil {
+        err := s.Sqlite.Close()
+        assert.NoError(err, "sqlite errored on close")
+        s.Sqlite = nil
+    }
 }
 
 func (s *ServerState) String() string {
@@ -61,6 +88,9 @@ type TestingClientFactory struct {
     host string
     port uint16
     logger *slog.Logger
+    wait sync.WaitGroup
+    connects atomic.Int64
+    disconnects atomic.Int64
 }
 
 func NewTestingClientFactory(host string, port uint16, logger *slog.Logger) TestingClientFactory {
@@ -71,14 +101,14 @@ func NewTestingClientFactory(host string, port uint16, logger *slog.Logger) Test
     }
 }
 
-func (f *TestingClientFactory) CreateBatchedConnections(count int) []*dummy.DummyClient {
+func (f *TestingClientFactory) CreateBatchedConnections(ctx context.Context, count int) []*dummy.DummyClient {
     conns := make([]*dummy.DummyClient, 0)
 
     wait := sync.WaitGroup{}
     wait.Add(count)
     f.logger.Info("creating all clients", "count", count)
     for range count {
-        conns = append(conns, f.NewWait(&wait))
+        conns = append(conns, f.NewWait(ctx, &wait))
     }
     wait.Wait()
     f.logger.Info("clients all created", "count", count)
@@ -93,48 +123,107 @@ func (f TestingClientFactory) WithPort(port uint16) TestingClientFactory {
 }
 
 func (f *TestingClientFactory) New() *dummy.DummyClient {
+    client, err := f.NewE(context.Background())
+    assert.NoError(err, "unable to connect client")
+    return client
+}
+
+// NewE is the error-returning counterpart of New, used by Workload steps
+// that need to know whether a connect actually succeeded.
+func (f *TestingClientFactory) NewE(ctx context.Context) (*dummy.DummyClient, error) {
     client := dummy.NewDummyClient(f.host, f.port)
     f.logger.Info("factory connecting", "id", client.ConnId)
-    client.Connect(context.Background())
+    err := client.Connect(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("client %s failed to connect: %w", client.ConnId, err)
+    }
     f.logger.Info("factory connected", "id", client.ConnId)
-    return &client
+    f.connects.Add(1)
+    return &client, nil
+}
+
+// recordDisconnect tracks a client the factory created dropping out from
+// under a Workload, e.g. ConstantConcurrency noticing it needs to
+// reconnect. It's surfaced on the /metrics endpoint EnableDiagnostics
+// registers.
+func (f *TestingClientFactory) recordDisconnect() {
+    f.disconnects.Add(1)
+}
+
+// Stats returns the factory's running connect/disconnect counts.
+func (f *TestingClientFactory) Stats() (connects int64, disconnects int64) {
+    return f.connects.Load(), f.disconnects.Load()
 }
 
 // this is getting hacky...
-func (f *TestingClientFactory) NewWait(wait *sync.WaitGroup) *dummy.DummyClient {
+func (f *TestingClientFactory) NewWait(ctx context.Context, wait *sync.WaitGroup) *dummy.DummyClient {
     client := dummy.NewDummyClient(f.host, f.port)
     f.logger.Info("factory new client with wait", "id", client.ConnId)
 
+    f.wait.Add(1)
     go func() {
         defer wait.Done()
+        defer f.wait.Done()
 
         f.logger.Info("factory client connecting with wait", "id", client.ConnId)
-        client.Connect(context.Background())
+        err := client.Connect(ctx)
+        if err != nil {
+            f.logger.Error("factory client connect failed", "id", client.ConnId, "err", err)
+            return
+        }
         f.logger.Info("factory client connected with wait", "id", client.ConnId)
+        f.connects.Add(1)
     }()
 
     return &client
 }
 
-func createServer(ctx context.Context, server *ServerState, logger *slog.Logger) (string, *gameserverstats.GameServerConfig) {
+// Wait blocks until every client this factory has created via NewWait has
+// either connected or given up, regardless of which caller-supplied
+// WaitGroup those connects were also tracked on. RunUntilSignal uses this
+// to bound shutdown on in-flight connects.
+func (f *TestingClientFactory) Wait() {
+    f.wait.Wait()
+}
+
+func createServerE(ctx context.Context, server *ServerState, logger *slog.Logger) (string, *gameserverstats.GameServerConfig, error) {
     logger.Info("creating server")
     sId, err := server.Server.CreateNewServer(ctx)
-    logger.Info("created server", "id", sId, "err", err)
-    assert.NoError(err, "unable to create server")
+    if err != nil {
+        return "", nil, fmt.Errorf("unable to create server: %w", err)
+    }
+    logger.Info("created server", "id", sId)
+
     logger.Info("waiting server...", "id", sId)
-    server.Server.WaitForReady(ctx, sId)
+    err = server.Server.WaitForReady(ctx, sId)
+    if err != nil {
+        return "", nil, fmt.Errorf("server %s never became ready: %w", sId, err)
+    }
     logger.Info("server ready", "id", sId)
+
     sConfig := server.Sqlite.GetById(sId)
+    if sConfig == nil {
+        return "", nil, fmt.Errorf("unable to get config by id %s", sId)
+    }
     logger.Info("server config", "config", sConfig)
-    assert.NotNil(sConfig, "unable to get config by id", "id", sId)
-    return sId, sConfig
+    return sId, sConfig, nil
 }
 
 type ConnMap map[string][]*dummy.DummyClient
 
-func hydrateServers(ctx context.Context, server *ServerState, logger *slog.Logger) ConnMap {
+// Hydrate creates and connects every server described by the current game
+// server configs, returning the resulting ConnMap. It returns the first
+// error it hits instead of asserting, so a caller running a long
+// simulation sweep can decide whether to retry, skip, or abort. A client
+// that fails to connect inside a server's batch is logged by the factory
+// and not returned as an error.
+func (server *ServerState) Hydrate(ctx context.Context) (ConnMap, error) {
+    logger := slog.Default().With("area", "create-env")
+
     configs, err := server.Sqlite.GetAllGameServerConfigs()
-    assert.NoError(err, "unable to get game server configs")
+    if err != nil {
+        return nil, fmt.Errorf("unable to get game server configs: %w", err)
+    }
 
     connMap := make(ConnMap)
     logger.Info("Hydrating Servers", "count", len(configs))
@@ -142,14 +231,17 @@ func hydrateServers(ctx context.Context, server *ServerState, logger *slog.Logge
 
         logger.Info("Creating server with the following config", "config", c)
 
-        sId, sConfig := createServer(ctx, server, logger)
+        sId, sConfig, err := createServerE(ctx, server, logger)
+        if err != nil {
+            return nil, fmt.Errorf("unable to hydrate server for config %s: %w", c, err)
+        }
         factory := server.Factory.WithPort(uint16(sConfig.Port))
-        conns := factory.CreateBatchedConnections(c.Connections)
+        conns := factory.CreateBatchedConnections(ctx, c.Connections)
 
         connMap[sId] = conns
     }
 
-    return connMap
+    return connMap, nil
 }
 
 func copyFile(from string, to string) {
@@ -187,44 +279,112 @@ func GetDBPath(name string) string {
     return path.Join(cwd, "data", name)
 }
 
+// CreateEnvironment is a thin wrapper around CreateEnvironmentE that asserts
+// instead of returning an error, preserving the behavior existing call
+// sites rely on.
 func CreateEnvironment(ctx context.Context, path string, params servermanagement.ServerParams) ServerState {
+    server, err := CreateEnvironmentE(ctx, path, params)
+    assert.NoError(err, "unable to create environment")
+    return server
+}
+
+// CreateEnvironmentE is the error-returning counterpart of CreateEnvironment.
+// On failure it returns whatever partially-constructed ServerState it got
+// to, so callers should defer server.Close() before checking err.
+func CreateEnvironmentE(ctx context.Context, path string, params servermanagement.ServerParams) (ServerState, error) {
     logger := slog.Default().With("area", "create-env")
     logger.Warn("copying db file", "path", path)
     path = copyDBFile(path)
     os.Setenv("SQLITE", path)
 
-    port, err := dummy.GetFreePort()
-    assert.NoError(err, "unable to get a free port")
-
     logger.Info("creating sqlite", "path", path)
     sqlite := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(path))
+
+    return createEnvironmentFromSqliteE(ctx, sqlite, params, logger)
+}
+
+// SeedFunc populates an already-migrated in-memory database with the game
+// server configs a test needs. It runs before the matchmaking server and
+// local servers are wired up, so it is the only safe place to write rows.
+type SeedFunc func(sqlite *gameserverstats.Sqlite) error
+
+// inMemoryDBCounter gives each CreateEnvironmentInMemory call a distinct
+// shared-cache database name within this process.
+var inMemoryDBCounter atomic.Int64
+
+// CreateEnvironmentInMemory builds a ServerState backed by a shared-cache
+// in-memory sqlite database instead of a copy of an on-disk file. It is
+// meant for unit tests: there's no tmp file to leak on crash and no WAL to
+// race with, at the cost of not being representative of the on-disk
+// checkpoint behavior CreateEnvironment exercises.
+func CreateEnvironmentInMemory(ctx context.Context, seed SeedFunc, params servermanagement.ServerParams) ServerState {
+    logger := slog.Default().With("area", "create-env")
+
+    // A shared-cache in-memory database is keyed by name, not by the query
+    // string, so each call needs a distinct name to avoid colliding with
+    // every other in-memory env in this process.
+    name := inMemoryDBCounter.Add(1)
+    uri := fmt.Sprintf("file:sim-env-%d?mode=memory&cache=shared", name)
+    logger.Info("creating in-memory sqlite", "uri", uri)
+    sqlite := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(uri))
+
+    err := sqlite.Migrate()
+    assert.NoError(err, "unable to migrate in-memory sqlite")
+
+    err = seed(sqlite)
+    assert.NoError(err, "seed func errored")
+
+    server, err := createEnvironmentFromSqliteE(ctx, sqlite, params, logger)
+    assert.NoError(err, "unable to create in-memory environment")
+    return server
+}
+
+// createEnvironmentFromSqliteE wires up local servers, matchmaking, and the
+// client factory on top of an already-opened sqlite handle, then hydrates
+// servers for every config row it finds. CreateEnvironmentE and
+// CreateEnvironmentInMemory only differ in how that handle is obtained.
+// On error it returns the ServerState built so far so the caller can Close
+// it.
+func createEnvironmentFromSqliteE(ctx context.Context, sqlite *gameserverstats.Sqlite, params servermanagement.ServerParams, logger *slog.Logger) (ServerState, error) {
+    // envCtx, not ctx, is what mm.Run and Hydrate are given below, so it's
+    // what every connect goroutine they spawn selects on. Stashing cancel
+    // lets RunUntilSignal actually unwind those goroutines on a signal
+    // instead of only bounding them with a grace timeout.
+    envCtx, cancel := context.WithCancel(ctx)
+    server := ServerState{Sqlite: sqlite, cancel: cancel}
+
+    port, err := dummy.GetFreePort()
+    if err != nil {
+        return server, fmt.Errorf("unable to get a free port: %w", err)
+    }
+    server.Port = port
+
     logger.Info("creating local servers", "params", params)
     local := servermanagement.NewLocalServers(sqlite, params)
-    logger.Info("creating matchmaking", "port", port)
+    server.Server = &local
 
+    logger.Info("creating matchmaking", "port", port)
     mm := matchmaking.NewMatchMakingServer(matchmaking.MatchMakingServerParams{
         Port: port,
         GameServer: &local,
     })
-    go mm.Run(ctx)
-    mm.WaitForReady(ctx)
+    server.MatchMaking = mm
+    go mm.Run(envCtx)
+    if err := mm.WaitForReady(envCtx); err != nil {
+        return server, fmt.Errorf("matchmaking server never became ready: %w", err)
+    }
 
     logger.Info("creating client factory", "port", port)
     factory := NewTestingClientFactory("0.0.0.0", uint16(port), logger)
-
-    logger.Info("creating server state object", "port", port)
-    server := ServerState{
-        Sqlite: sqlite,
-        Server: &local,
-        MatchMaking: mm,
-        Port: port,
-        Factory: &factory,
-        Conns: nil,
-    }
+    server.Factory = &factory
 
     logger.Info("hydrating servers", "port", port)
-    server.Conns = hydrateServers(ctx, &server, logger)
+    conns, err := server.Hydrate(envCtx)
+    if err != nil {
+        return server, fmt.Errorf("unable to hydrate servers: %w", err)
+    }
+    server.Conns = conns
 
     logger.Info("environment fully created")
-    return server
+    return server, nil
 }
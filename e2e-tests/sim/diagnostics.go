@@ -0,0 +1,83 @@
+package sim
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/http/pprof"
+    "runtime"
+
+    "vim-arcade.theprimeagen.com/pkg/dummy"
+)
+
+// EnableDiagnostics starts a private HTTP server exposing net/http/pprof's
+// handlers plus a /metrics endpoint, so a stuck or misbehaving sim run can
+// be introspected from outside the process. If addr is empty, a free port
+// on localhost is chosen and can be read back from s.DiagnosticsAddr. The
+// server is shut down by ServerState.Close.
+func (s *ServerState) EnableDiagnostics(addr string) error {
+    logger := slog.Default().With("area", "diagnostics")
+
+    if addr == "" {
+        port, err := dummy.GetFreePort()
+        if err != nil {
+            return fmt.Errorf("unable to get a free port for diagnostics: %w", err)
+        }
+        addr = fmt.Sprintf("127.0.0.1:%d", port)
+    }
+
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return fmt.Errorf("unable to listen on %s for diagnostics: %w", addr, err)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    mux.HandleFunc("/metrics", s.handleMetrics)
+
+    srv := &http.Server{Handler: mux}
+    s.Diagnostics = srv
+    s.DiagnosticsAddr = ln.Addr().String()
+
+    go func() {
+        logger.Info("diagnostics server listening", "addr", s.DiagnosticsAddr)
+        if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+            logger.Error("diagnostics server errored", "err", err)
+        }
+    }()
+
+    return nil
+}
+
+func (s *ServerState) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    configs, err := s.Sqlite.GetAllGameServerConfigs()
+    if err != nil {
+        http.Error(w, fmt.Sprintf("unable to get game server configs: %s", err), http.StatusInternalServerError)
+        return
+    }
+
+    connections := s.Sqlite.GetTotalConnectionCount()
+    connects, disconnects := s.Factory.Stats()
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    fmt.Fprintf(w, "sqlite_connections %s\n", connections.String())
+    fmt.Fprintf(w, "game_server_configs %d\n", len(configs))
+    fmt.Fprintf(w, "goroutines %d\n", runtime.NumGoroutine())
+    fmt.Fprintf(w, "factory_connects %d\n", connects)
+    fmt.Fprintf(w, "factory_disconnects %d\n", disconnects)
+}
+
+// closeDiagnostics shuts the diagnostics server down, if one was started.
+func (s *ServerState) closeDiagnostics() {
+    if s.Diagnostics == nil {
+        return
+    }
+    _ = s.Diagnostics.Shutdown(context.Background())
+    s.Diagnostics = nil
+}
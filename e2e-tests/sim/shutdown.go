@@ -0,0 +1,58 @@
+package sim
+
+import (
+    "context"
+    "log/slog"
+    "os"
+    "os/signal"
+    "time"
+)
+
+// RunUntilSignal blocks until ctx is cancelled or one of signals is
+// received, then tears the environment down: it cancels the context that
+// mm.Run and Hydrate were started with (so in-flight NewWait goroutines see
+// it and unwind instead of only being bounded by the grace timeout below),
+// waits up to grace for the factory's outstanding connects to finish via
+// Factory.Wait(), and finally closes the environment in reverse-
+// construction order (matchmaking, then local servers, then sqlite). If no
+// signals are given it defaults to os.Interrupt. A clean signal-driven
+// shutdown returns nil; if ctx itself was cancelled by the caller, that
+// error is returned instead.
+func (s *ServerState) RunUntilSignal(ctx context.Context, grace time.Duration, signals ...os.Signal) error {
+    logger := slog.Default().With("area", "run-until-signal")
+    if len(signals) == 0 {
+        signals = []os.Signal{os.Interrupt}
+    }
+
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, signals...)
+    defer signal.Stop(sigCh)
+
+    var err error
+    select {
+    case <-ctx.Done():
+        err = ctx.Err()
+    case sig := <-sigCh:
+        logger.Info("received signal, shutting down", "signal", sig)
+    }
+
+    if s.cancel != nil {
+        s.cancel()
+    }
+
+    done := make(chan struct{})
+    go func() {
+        s.Factory.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        logger.Info("all outstanding connects finished")
+    case <-time.After(grace):
+        logger.Warn("grace period exceeded, closing with connects still outstanding", "grace", grace)
+    }
+
+    s.Close()
+    return err
+}
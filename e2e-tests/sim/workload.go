@@ -0,0 +1,272 @@
+package sim
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math/rand"
+    "sort"
+    "sync"
+    "time"
+
+    "vim-arcade.theprimeagen.com/pkg/dummy"
+)
+
+// ErrWorkloadDone is returned by Workload.Step once that workload has run
+// its course (e.g. its configured duration elapsed). Burst never returns
+// it. RunWorkload treats it as a clean stop rather than a step failure.
+var ErrWorkloadDone = errors.New("workload done")
+
+// Workload drives client traffic against a ServerState one step at a time.
+// Step should block for as long as this step's pacing requires (an
+// inter-arrival delay, a tick interval, ...) before or after it connects,
+// but the returned duration must cover only the connect itself, not the
+// pacing delay, since RunWorkload records it as a connect latency sample.
+// A zero duration with a nil error means the step did no connect this time
+// (e.g. polling while already at capacity) and is not recorded. Step
+// returns ErrWorkloadDone once it has nothing more to do; any other error
+// is recorded as a failed step but does not stop the run.
+type Workload interface {
+    Step(ctx context.Context, factory *TestingClientFactory, state *ServerState) (time.Duration, error)
+}
+
+// PoissonArrivals connects clients at a Poisson process: inter-arrival
+// times are drawn from an exponential distribution with the given Rate
+// (arrivals per second), for Duration before it reports ErrWorkloadDone.
+type PoissonArrivals struct {
+    Rate     float64
+    Duration time.Duration
+
+    deadline time.Time
+}
+
+func (p *PoissonArrivals) Step(ctx context.Context, factory *TestingClientFactory, state *ServerState) (time.Duration, error) {
+    if p.deadline.IsZero() {
+        p.deadline = time.Now().Add(p.Duration)
+    }
+    if time.Now().After(p.deadline) {
+        return 0, ErrWorkloadDone
+    }
+
+    interArrival := time.Duration(rand.ExpFloat64() / p.Rate * float64(time.Second))
+    select {
+    case <-ctx.Done():
+        return 0, ctx.Err()
+    case <-time.After(interArrival):
+    }
+
+    start := time.Now()
+    _, err := factory.NewE(ctx)
+    return time.Since(start), err
+}
+
+// defaultPollInterval is how often ConstantConcurrency rechecks for
+// dropped clients to replace once it's already holding N of them, so it
+// polls instead of busy-spinning for the rest of HoldFor.
+const defaultPollInterval = 50 * time.Millisecond
+
+// ConstantConcurrency keeps N clients connected at all times for HoldFor,
+// reconnecting any that drop in the meantime. It checks for drops and
+// tops up at most one client per Step call, polling every PollInterval
+// (defaultPollInterval if unset) once it's already at N so it doesn't
+// spin the CPU for the rest of HoldFor.
+type ConstantConcurrency struct {
+    N            int
+    HoldFor      time.Duration
+    PollInterval time.Duration
+
+    deadline time.Time
+    clients  []*dummy.DummyClient
+}
+
+func (c *ConstantConcurrency) Step(ctx context.Context, factory *TestingClientFactory, state *ServerState) (time.Duration, error) {
+    if c.deadline.IsZero() {
+        c.deadline = time.Now().Add(c.HoldFor)
+        c.clients = make([]*dummy.DummyClient, 0, c.N)
+    }
+    if time.Now().After(c.deadline) {
+        return 0, ErrWorkloadDone
+    }
+
+    alive := c.clients[:0]
+    for _, client := range c.clients {
+        if client.Closed() {
+            factory.recordDisconnect()
+            continue
+        }
+        alive = append(alive, client)
+    }
+    c.clients = alive
+
+    if len(c.clients) >= c.N {
+        pollInterval := c.PollInterval
+        if pollInterval <= 0 {
+            pollInterval = defaultPollInterval
+        }
+        select {
+        case <-ctx.Done():
+            return 0, ctx.Err()
+        case <-time.After(pollInterval):
+        }
+        return 0, nil
+    }
+
+    start := time.Now()
+    client, err := factory.NewE(ctx)
+    latency := time.Since(start)
+    if err != nil {
+        return latency, err
+    }
+    c.clients = append(c.clients, client)
+    return latency, nil
+}
+
+// Burst connects Count clients every Every, indefinitely until ctx is
+// cancelled.
+type Burst struct {
+    Count int
+    Every time.Duration
+
+    next time.Time
+}
+
+func (b *Burst) Step(ctx context.Context, factory *TestingClientFactory, state *ServerState) (time.Duration, error) {
+    if b.next.IsZero() {
+        b.next = time.Now()
+    }
+
+    if wait := time.Until(b.next); wait > 0 {
+        select {
+        case <-ctx.Done():
+            return 0, ctx.Err()
+        case <-time.After(wait):
+        }
+    }
+    b.next = b.next.Add(b.Every)
+
+    start := time.Now()
+    factory.CreateBatchedConnections(ctx, b.Count)
+    return time.Since(start), nil
+}
+
+// latencyReservoir is a uniform reservoir sample of latencies, used so
+// WorkloadReport can report percentiles without keeping every observation
+// from a long-running sim.
+type latencyReservoir struct {
+    mu       sync.Mutex
+    capacity int
+    seen     int
+    samples  []time.Duration
+}
+
+func newLatencyReservoir(capacity int) *latencyReservoir {
+    return &latencyReservoir{capacity: capacity}
+}
+
+func (r *latencyReservoir) Add(d time.Duration) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.seen++
+    if len(r.samples) < r.capacity {
+        r.samples = append(r.samples, d)
+        return
+    }
+
+    if j := rand.Intn(r.seen); j < r.capacity {
+        r.samples[j] = d
+    }
+}
+
+func (r *latencyReservoir) Percentile(p float64) time.Duration {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if len(r.samples) == 0 {
+        return 0
+    }
+
+    sorted := append([]time.Duration(nil), r.samples...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    idx := int(p * float64(len(sorted)-1))
+    return sorted[idx]
+}
+
+// WorkloadReport summarizes a RunWorkload run: how many steps it took, how
+// many errored, and a latency distribution. Min and Max are tracked exactly
+// over every recorded step; p50/p95/p99 come from a reservoir sample so
+// memory stays bounded regardless of run length.
+type WorkloadReport struct {
+    Steps  int
+    Errors int
+    Min    time.Duration
+    Max    time.Duration
+
+    latencies *latencyReservoir
+}
+
+func newWorkloadReport() *WorkloadReport {
+    return &WorkloadReport{latencies: newLatencyReservoir(1024)}
+}
+
+func (r *WorkloadReport) record(latency time.Duration, err error) {
+    r.Steps++
+    if err != nil {
+        r.Errors++
+    }
+    if r.Min == 0 || latency < r.Min {
+        r.Min = latency
+    }
+    if latency > r.Max {
+        r.Max = latency
+    }
+    r.latencies.Add(latency)
+}
+
+func (r *WorkloadReport) P50() time.Duration { return r.latencies.Percentile(0.50) }
+func (r *WorkloadReport) P95() time.Duration { return r.latencies.Percentile(0.95) }
+func (r *WorkloadReport) P99() time.Duration { return r.latencies.Percentile(0.99) }
+
+func (r *WorkloadReport) String() string {
+    return fmt.Sprintf(`WorkloadReport:
+Steps: %d
+Errors: %d
+Min: %s
+P50: %s
+P95: %s
+P99: %s
+Max: %s
+`, r.Steps, r.Errors, r.Min, r.P50(), r.P95(), r.P99(), r.Max)
+}
+
+// RunWorkload drives w one step at a time against s until it reports
+// ErrWorkloadDone or ctx is cancelled, recording each step's connect
+// latency and errors into the returned WorkloadReport. Steps that made no
+// connect attempt (a zero duration with a nil error) aren't recorded.
+func (s *ServerState) RunWorkload(ctx context.Context, w Workload) *WorkloadReport {
+    logger := slog.Default().With("area", "workload")
+    report := newWorkloadReport()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return report
+        default:
+        }
+
+        latency, err := w.Step(ctx, s.Factory, s)
+
+        if errors.Is(err, ErrWorkloadDone) {
+            logger.Info("workload finished", "steps", report.Steps)
+            return report
+        }
+        if latency == 0 && err == nil {
+            continue
+        }
+        if err != nil {
+            logger.Warn("workload step errored", "err", err)
+        }
+        report.record(latency, err)
+    }
+}